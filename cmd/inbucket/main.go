@@ -2,12 +2,10 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"expvar"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"os/signal"
 	"runtime"
@@ -15,11 +13,14 @@ import (
 	"time"
 
 	"github.com/inbucket/inbucket/pkg/config"
+	ibxlog "github.com/inbucket/inbucket/pkg/log"
 	"github.com/inbucket/inbucket/pkg/message"
 	"github.com/inbucket/inbucket/pkg/msghub"
 	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/relay"
 	"github.com/inbucket/inbucket/pkg/rest"
 	"github.com/inbucket/inbucket/pkg/server"
+	"github.com/inbucket/inbucket/pkg/server/imap"
 	"github.com/inbucket/inbucket/pkg/server/pop3"
 	"github.com/inbucket/inbucket/pkg/server/smtp"
 	"github.com/inbucket/inbucket/pkg/server/web"
@@ -28,7 +29,6 @@ import (
 	"github.com/inbucket/inbucket/pkg/storage/mem"
 	"github.com/inbucket/inbucket/pkg/stringutil"
 	"github.com/inbucket/inbucket/pkg/webui"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -40,19 +40,12 @@ var (
 	date = "undefined"
 )
 
-type ServerTuple struct {
-	v4 server.IServer
-	v6 server.IServer
-}
+// drainTimeout bounds how long main waits for subsystems to finish draining after shutdown is
+// requested, replacing the old hard os.Exit(0) timer with a cancelable deadline.
+const drainTimeout = 15 * time.Second
 
-func (st *ServerTuple) Drain() {
-	if st.v4 != nil {
-		st.v4.Drain()
-	}
-	if st.v6 != nil {
-		st.v6.Drain()
-	}
-}
+// relayWorkerCount bounds how many relay attempts run concurrently.
+const relayWorkerCount = 4
 
 func init() {
 	// Server uptime for status page.
@@ -102,16 +95,20 @@ func main() {
 	}
 
 	// Logger setup.
-	closeLog, err := openLog(conf.LogLevel, *logfile, *logjson, false)
+	logMgr, err := ibxlog.Open(conf.LogLevel, *logfile, *logjson, false)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Log error: %v\n", err)
 		os.Exit(1)
 	}
 	startupLog := log.With().Str("phase", "startup").Logger()
 
-	// Setup signal handler.
+	// Setup signal handlers: SIGINT/SIGTERM request a shutdown, SIGHUP (where available)
+	// reopens the logfile and reloads the log level without restarting. The POP3/SMTP debug
+	// flags are not reloaded.
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	reloadChan := make(chan os.Signal, 1)
+	notifyReload(reloadChan)
 
 	// Initialize logging.
 	startupLog.Info().Str("version", config.Version).Str("buildDate", config.BuildDate).
@@ -130,134 +127,124 @@ func main() {
 	}
 
 	// Configure internal services.
-	rootCtx, rootCancel := context.WithCancel(context.Background())
-	shutdownChan := make(chan bool)
 	store, err := storage.FromConfig(conf.Storage)
 	if err != nil {
 		removePIDFile(*pidfile)
 		startupLog.Fatal().Err(err).Str("module", "storage").Msg("Fatal storage error")
 	}
-	msgHub := msghub.New(rootCtx, conf.Web.MonitorHistory)
+	msgHub := msghub.New(conf.Web.MonitorHistory)
 	addrPolicy := &policy.Addressing{Config: conf}
 	mmanager := &message.StoreManager{AddrPolicy: addrPolicy, Store: store, Hub: msgHub}
+	if len(conf.Relay.Rules) > 0 {
+		mmanager.AddDispatcher(relay.New(conf.Relay, mmanager, relayWorkerCount))
+	}
 
-	// Start Retention scanner.
-	retentionScanner := storage.NewRetentionScanner(conf.Storage, store, shutdownChan)
-	retentionScanner.Start()
+	// Build the supervisor and register every subsystem; nothing below actually starts a
+	// goroutine until supv.Serve runs them.
+	supv := server.NewSupervisor()
+	supv.Add("msghub", msgHub)
+	supv.Add("retention", storage.NewRetentionScanner(conf.Storage, store))
 
 	if conf.Web.Enabled {
-		// Configure routes and start HTTP server.
+		// Configure routes.
 		prefix := stringutil.MakePathPrefixer(conf.Web.BasePath)
 		webui.SetupRoutes(web.Router.PathPrefix(prefix("/serve/")).Subrouter())
 		rest.SetupRoutes(web.Router.PathPrefix(prefix("/api/")).Subrouter())
-		web.Initialize(conf, shutdownChan, mmanager, msgHub)
-		go web.Start(rootCtx)
+		rest.SetupAdminRoutes(web.Router.PathPrefix(prefix("/api/v1/admin/")).Subrouter(),
+			logMgr, conf.Web.AdminToken)
+		rest.SetupEventRoutes(web.Router.PathPrefix(prefix("/api/v2/")).Subrouter(), msgHub)
+		web.Initialize(conf, mmanager, msgHub)
+		supv.Add("web", server.FuncService(web.Serve))
 	}
 
-	var pop3ServerTuple ServerTuple
 	if conf.POP3.Enabled {
-		// Start POP3 server.
 		if conf.POP3.Addr != "" {
-			pop3ServerTuple.v4 = pop3.New(conf.POP3, conf.POP3.Addr, "tcp4", shutdownChan, store)
-			go pop3ServerTuple.v4.Start(rootCtx)
+			supv.Add("pop3-v4", pop3.New(conf.POP3, conf.POP3.Addr, "tcp4", store))
 		}
 		if conf.POP3.Addrv6 != "" {
-			pop3ServerTuple.v6 = pop3.New(conf.POP3, conf.POP3.Addrv6, "tcp6", shutdownChan, store)
-			go pop3ServerTuple.v6.Start(rootCtx)
+			supv.Add("pop3-v6", pop3.New(conf.POP3, conf.POP3.Addrv6, "tcp6", store))
 		}
 	}
 
-	var smtpServerTuple ServerTuple
 	if conf.SMTP.Enabled {
-		// Start SMTP server.
 		if conf.SMTP.Addr != "" {
-			smtpServerTuple.v4 = smtp.NewServer(conf.SMTP, "tcp4", shutdownChan, mmanager, addrPolicy)
-			go smtpServerTuple.v4.Start(rootCtx)
+			supv.Add("smtp-v4", smtp.NewServer(conf.SMTP, "tcp4", mmanager, addrPolicy))
 		}
 		if conf.SMTP.Addrv6 != "" {
-			smtpServerTuple.v6 = smtp.NewServer(conf.SMTP, "tcp6", shutdownChan, mmanager, addrPolicy)
-			go smtpServerTuple.v6.Start(rootCtx)
+			supv.Add("smtp-v6", smtp.NewServer(conf.SMTP, "tcp6", mmanager, addrPolicy))
 		}
 	}
 
-	// Loop forever waiting for signals or shutdown channel.
-signalLoop:
+	if conf.IMAP.Enabled {
+		if conf.IMAP.Addr != "" {
+			supv.Add("imap-v4", imap.New(conf.IMAP, conf.IMAP.Addr, "tcp4", store, msgHub))
+		}
+		if conf.IMAP.Addrv6 != "" {
+			supv.Add("imap-v6", imap.New(conf.IMAP, conf.IMAP.Addrv6, "tcp6", store, msgHub))
+		}
+	}
+
+	rootCtx, rootCancel := context.WithCancel(context.Background())
+	supvDone := make(chan error, 1)
+	go func() { supvDone <- supv.Serve(rootCtx) }()
+	supvExited := false
+
+	// Wait for a shutdown signal, a reload signal, or a fatal, unrecoverable supervisor error.
+waitLoop:
 	for {
 		select {
+		case <-reloadChan:
+			reload(logMgr)
 		case sig := <-sigChan:
-			switch sig {
-			case syscall.SIGINT:
-				// Shutdown requested
-				log.Info().Str("phase", "shutdown").Str("signal", "SIGINT").
-					Msg("Received SIGINT, shutting down")
-				close(shutdownChan)
-			case syscall.SIGTERM:
-				// Shutdown requested
-				log.Info().Str("phase", "shutdown").Str("signal", "SIGTERM").
-					Msg("Received SIGTERM, shutting down")
-				close(shutdownChan)
-			}
-		case <-shutdownChan:
-			rootCancel()
-			break signalLoop
+			log.Info().Str("phase", "shutdown").Str("signal", sig.String()).
+				Msg("Received shutdown signal, shutting down")
+			break waitLoop
+		case err := <-supvDone:
+			supvExited = true
+			log.Error().Str("phase", "shutdown").Err(err).
+				Msg("Supervisor exited unexpectedly, shutting down")
+			break waitLoop
 		}
 	}
+	rootCancel()
 
-	// Wait for active connections to finish.
-	go timedExit(*pidfile)
-	smtpServerTuple.Drain()
-	pop3ServerTuple.Drain()
+	// Bound how long we wait for subsystems to drain their active connections. If the
+	// supervisor already returned, its subsystems have stopped and there is nothing to wait for.
+	if !supvExited {
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer drainCancel()
+		select {
+		case <-supvDone:
+		case <-drainCtx.Done():
+			log.Error().Str("phase", "shutdown").Msg("Clean shutdown took too long, forcing exit")
+		}
+	}
 
-	retentionScanner.Join()
 	removePIDFile(*pidfile)
-	closeLog()
+	if err := logMgr.Close(); err != nil {
+		log.Error().Str("phase", "shutdown").Err(err).Msg("Failed to close logfile")
+	}
 }
 
-// openLog configures zerolog output, returns func to close logfile.
-func openLog(level string, logfile string, json bool, setColor bool) (close func(), err error) {
-	switch level {
-	case "debug":
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	case "info":
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	case "warn":
-		zerolog.SetGlobalLevel(zerolog.WarnLevel)
-	case "error":
-		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-	default:
-		return nil, fmt.Errorf("Log level %q not one of: debug, info, warn, error", level)
+// reload reopens the logfile and re-reads the config's log level, applying it without requiring
+// a restart; the POP3/SMTP debug flags are left as they were at startup. It is invoked by the
+// SIGHUP handler, and does the same work the /api/v1/admin/log REST endpoint performs for
+// platforms without SIGHUP.
+func reload(logMgr *ibxlog.Manager) {
+	rlog := log.With().Str("phase", "reload").Logger()
+	if err := logMgr.Reopen(); err != nil {
+		rlog.Error().Err(err).Msg("Failed to reopen logfile")
 	}
-	close = func() {}
-	var w io.Writer
-	color := setColor && runtime.GOOS != "windows"
-	switch logfile {
-	case "stderr":
-		w = os.Stderr
-	case "stdout":
-		w = os.Stdout
-	default:
-		logf, err := os.OpenFile(logfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
-		if err != nil {
-			return nil, err
-		}
-		bw := bufio.NewWriter(logf)
-		w = bw
-		color = false
-		close = func() {
-			_ = bw.Flush()
-			_ = logf.Close()
-		}
+	conf, err := config.Process()
+	if err != nil {
+		rlog.Error().Err(err).Msg("Failed to re-read configuration, keeping prior settings")
+		return
 	}
-	w = zerolog.SyncWriter(w)
-	if json {
-		log.Logger = log.Output(w)
-		return close, nil
+	if err := logMgr.SetLevel(conf.LogLevel); err != nil {
+		rlog.Error().Err(err).Msg("Failed to apply reloaded log level")
+		return
 	}
-	log.Logger = log.Output(zerolog.ConsoleWriter{
-		Out:     w,
-		NoColor: !color,
-	})
-	return close, nil
+	rlog.Info().Str("level", conf.LogLevel).Msg("Reloaded log level")
 }
 
 // removePIDFile removes the PID file if created.
@@ -269,11 +256,3 @@ func removePIDFile(pidfile string) {
 		}
 	}
 }
-
-// timedExit is called as a goroutine during shutdown, it will force an exit after 15 seconds.
-func timedExit(pidfile string) {
-	time.Sleep(15 * time.Second)
-	removePIDFile(pidfile)
-	log.Error().Str("phase", "shutdown").Msg("Clean shutdown took too long, forcing exit")
-	os.Exit(0)
-}
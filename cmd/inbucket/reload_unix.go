@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReload registers the SIGHUP handler used to trigger log rotation and a config reload
+// on platforms that support it. Windows has no SIGHUP; see reload_windows.go.
+func notifyReload(ch chan os.Signal) {
+	signal.Notify(ch, syscall.SIGHUP)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyReload is a no-op on Windows, which has no SIGHUP; the equivalent log
+// reopen/relevel operations are exposed instead via the authenticated /api/v1/admin/log
+// REST endpoint (see pkg/rest/adminlog.go). Neither offers a debug-flag toggle.
+func notifyReload(ch chan os.Signal) {}
@@ -0,0 +1,35 @@
+package config
+
+// Relay configures optional SMTP forwarding of selected mail to a real destination, so
+// Inbucket can double as a staging MTA that captures everything locally but still lets a
+// named allow-list of addresses reach production recipients.
+type Relay struct {
+	Rules []RelayRule
+}
+
+// RelayRule matches inbound mail by recipient mailbox glob (e.g. "ops-*") and, on a match,
+// relays it via Smarthost.
+type RelayRule struct {
+	// Match is a glob pattern (as accepted by path/filepath.Match) tested against the
+	// message's recipient mailbox -- the address Inbucket actually received the mail for, not
+	// any address listed in its To: header.
+	Match string
+
+	// Action is the only thing a rule can currently do; "relay" forwards the message.
+	Action string
+
+	// Smarthost is the "host:port" of the real SMTP server to relay through.
+	Smarthost string
+
+	// Auth holds optional SMTP AUTH credentials for Smarthost.
+	Auth *RelayAuth
+
+	// RewriteFrom, if set, replaces the envelope sender before relaying.
+	RewriteFrom string
+}
+
+// RelayAuth holds plain SMTP AUTH credentials for a RelayRule's smarthost.
+type RelayAuth struct {
+	Username string
+	Password string
+}
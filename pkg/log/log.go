@@ -0,0 +1,119 @@
+// Package log owns Inbucket's shared zerolog output so it can be safely reopened (for
+// external log rotation) and releveled while the daemon is running, without the rest of the
+// code needing to know where the log is actually going.
+package log
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Manager owns the current log output and lets callers reopen or relevel it from a different
+// goroutine than the one that opened it, e.g. a signal handler or REST request.
+type Manager struct {
+	mu       sync.Mutex
+	path     string
+	json     bool
+	setColor bool
+	closer   func() error
+}
+
+// Open configures zerolog's global logger to write to path ("stderr" and "stdout" are
+// special-cased) at the given level, returning a Manager that can reopen or relevel it later.
+func Open(level string, path string, json bool, setColor bool) (*Manager, error) {
+	m := &Manager{path: path, json: json, setColor: setColor}
+	if err := m.SetLevel(level); err != nil {
+		return nil, err
+	}
+	if err := m.open(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetLevel changes the global zerolog level; safe to call at any time, including while the
+// daemon is running.
+func (m *Manager) SetLevel(level string) error {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("log level %q not one of: debug, info, warn, error", level)
+	}
+	zerolog.SetGlobalLevel(lvl)
+	return nil
+}
+
+// Reopen closes and reopens the logfile, so an external tool (logrotate) can rename the old
+// file and HUP us to start writing to a fresh one without losing any buffered output. It is a
+// no-op when logging to stderr/stdout.
+func (m *Manager) Reopen() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.closeLocked(); err != nil {
+		return err
+	}
+	return m.openLocked()
+}
+
+// Close flushes and closes the underlying logfile, if any.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closeLocked()
+}
+
+func (m *Manager) open() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.openLocked()
+}
+
+func (m *Manager) openLocked() error {
+	var w io.Writer
+	color := m.setColor && runtime.GOOS != "windows"
+	switch m.path {
+	case "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		logf, err := os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriter(logf)
+		w = bw
+		color = false
+		m.closer = func() error {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			return logf.Close()
+		}
+	}
+	w = zerolog.SyncWriter(w)
+	if m.json {
+		log.Logger = log.Output(w)
+		return nil
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{
+		Out:     w,
+		NoColor: !color,
+	})
+	return nil
+}
+
+func (m *Manager) closeLocked() error {
+	if m.closer == nil {
+		return nil
+	}
+	err := m.closer()
+	m.closer = nil
+	return err
+}
@@ -0,0 +1,58 @@
+package message
+
+import (
+	"io"
+
+	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+// StoreManager is the entry point the SMTP server uses to persist incoming mail: it enforces
+// address policy, writes to storage.Store, publishes a message-stored event to Hub, and then
+// runs any registered Dispatchers.
+type StoreManager struct {
+	AddrPolicy *policy.Addressing
+	Store      storage.Store
+	Hub        *msghub.Hub
+
+	// Dispatchers run, in order, after a message is successfully delivered -- e.g. to relay a
+	// copy to a real mailbox. Dispatch returns no error, so a Dispatcher can never fail the
+	// original delivery; it handles any failure of its own.
+	Dispatchers []Dispatcher
+}
+
+// Dispatcher is notified after StoreManager successfully delivers a message, and may take its
+// own action (such as relaying it to a real SMTP server) without affecting delivery itself.
+type Dispatcher interface {
+	Dispatch(msg *Message)
+}
+
+// AddDispatcher registers a Dispatcher to run after every successful Deliver.
+func (m *StoreManager) AddDispatcher(d Dispatcher) {
+	m.Dispatchers = append(m.Dispatchers, d)
+}
+
+// Deliver parses and stores an inbound message for mailbox, publishes a message-stored event
+// to Hub, then hands the stored message to every registered Dispatcher before returning it.
+func (m *StoreManager) Deliver(reader io.Reader, mailbox string) (*Message, error) {
+	delivery, err := ParseDelivery(reader, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	id, err := m.Store.AddMessage(delivery)
+	if err != nil {
+		return nil, err
+	}
+	delivery.Meta.ID = id
+	msg := New(delivery.Meta, nil)
+
+	if m.Hub != nil {
+		meta := delivery.Meta
+		m.Hub.Dispatch(msghub.Message{Mailbox: mailbox, Event: "message-stored", Metadata: &meta})
+	}
+	for _, d := range m.Dispatchers {
+		d.Dispatch(msg)
+	}
+	return msg, nil
+}
@@ -0,0 +1,226 @@
+// Package relay implements an outbound forwarding message.Dispatcher: mail whose recipient
+// matches a configured rule is relayed to a real SMTP smarthost while Inbucket continues to
+// capture everything locally.
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// queueSize bounds how many messages may be waiting for a worker before Dispatch starts
+	// dropping them rather than blocking the SMTP receive goroutine.
+	queueSize = 256
+
+	minRetryBackoff = 5 * time.Second
+	maxRetryBackoff = 5 * time.Minute
+	maxAttempts     = 8
+)
+
+var (
+	relayedCount = expvar.NewInt("relayRelayed")
+	bouncedCount = expvar.NewInt("relayBounced")
+	droppedCount = expvar.NewInt("relayDropped")
+)
+
+// Dispatcher is a message.Dispatcher that relays mail matching one of its rules to a real
+// SMTP server, off the SMTP receive goroutine via a worker pool.
+type Dispatcher struct {
+	rules    []config.RelayRule
+	store    *message.StoreManager // Used to load message source and store bounce DSNs, never to re-Dispatch.
+	jobs     chan relayJob
+	wg       sync.WaitGroup
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// relayJob is one attempt to relay a stored message against a single matched rule.
+type relayJob struct {
+	msg     *message.Message
+	rule    config.RelayRule
+	attempt int
+}
+
+// New creates a relay Dispatcher with workerCount background workers draining its queue, and
+// store used to write bounce DSNs back into the original mailbox on permanent failure.
+func New(cfg config.Relay, store *message.StoreManager, workerCount int) *Dispatcher {
+	d := &Dispatcher{
+		rules:    cfg.Rules,
+		store:    store,
+		jobs:     make(chan relayJob, queueSize),
+		sendMail: smtp.SendMail,
+	}
+	for i := 0; i < workerCount; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d
+}
+
+// Dispatch implements message.Dispatcher. It matches msg's recipients against the configured
+// rules and enqueues a relay job for each match; it never blocks the caller.
+func (d *Dispatcher) Dispatch(msg *message.Message) {
+	for _, rule := range d.rules {
+		if rule.Action != "relay" {
+			continue
+		}
+		if !d.matches(msg, rule) {
+			continue
+		}
+		select {
+		case d.jobs <- relayJob{msg: msg, rule: rule}:
+		default:
+			droppedCount.Add(1)
+			log.Error().Str("module", "relay").Str("mailbox", msg.Mailbox).
+				Msg("Relay queue full, dropping message")
+		}
+	}
+}
+
+// matches reports whether msg's recipient mailbox matches rule.Match. Mailbox is the actual
+// address Inbucket received the message for, which is what RelayRule.Match is documented to
+// match against -- the message's To: header can list other recipients entirely (Bcc, mailing
+// lists, ...).
+func (d *Dispatcher) matches(msg *message.Message, rule config.RelayRule) bool {
+	ok, _ := filepath.Match(rule.Match, msg.Mailbox)
+	return ok
+}
+
+// recipientAddress reconstructs a routable RCPT TO address for msg's matched mailbox. Inbucket
+// mailbox names are the local part of the original recipient address, not a full address, so
+// this finds the To: entry whose local part matches and relays to that; it falls back to the
+// bare mailbox name (which a real smarthost will reject) only if no To: entry matches, e.g. a
+// recipient addressed solely via Bcc.
+func recipientAddress(msg *message.Message) string {
+	for _, addr := range msg.To {
+		if addr == nil {
+			continue
+		}
+		if strings.EqualFold(addrLocalPart(addr.Address), msg.Mailbox) {
+			return addr.Address
+		}
+	}
+	return msg.Mailbox
+}
+
+// addrLocalPart returns the portion of addr before the '@', or addr unchanged if it has none.
+func addrLocalPart(addr string) string {
+	if i := strings.IndexByte(addr, '@'); i >= 0 {
+		return addr[:i]
+	}
+	return addr
+}
+
+// worker drains jobs, relaying each one and requeueing with backoff on a transient failure.
+func (d *Dispatcher) worker() {
+	defer d.wg.Done()
+	for job := range d.jobs {
+		if err := d.attempt(job); err != nil {
+			d.retryOrBounce(job, err)
+		}
+	}
+}
+
+// attempt makes a single relay attempt for job.
+func (d *Dispatcher) attempt(job relayJob) error {
+	rc, err := d.store.Store.GetMessage(job.msg.Mailbox, job.msg.ID)
+	if err != nil {
+		return fmt.Errorf("relay: failed to load message: %w", err)
+	}
+	src, err := rc.Source()
+	if err != nil {
+		return fmt.Errorf("relay: failed to read message source: %w", err)
+	}
+	defer src.Close()
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return fmt.Errorf("relay: failed to read message source: %w", err)
+	}
+
+	from := job.msg.From.Address
+	if job.rule.RewriteFrom != "" {
+		from = job.rule.RewriteFrom
+	}
+	to := recipientAddress(job.msg)
+
+	var auth smtp.Auth
+	if job.rule.Auth != nil {
+		host := job.rule.Smarthost
+		if i := strings.IndexByte(host, ':'); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", job.rule.Auth.Username, job.rule.Auth.Password, host)
+	}
+
+	if err := d.sendMail(job.rule.Smarthost, auth, from, []string{to}, raw); err != nil {
+		return err
+	}
+	relayedCount.Add(1)
+	return nil
+}
+
+// retryOrBounce requeues job with capped exponential backoff, up to maxAttempts, after which
+// it synthesizes a DSN and delivers it back into the original mailbox. A permanent (5xx) SMTP
+// reply from the smarthost bounces at once without retrying.
+func (d *Dispatcher) retryOrBounce(job relayJob, relayErr error) {
+	job.attempt++
+	var smtpErr *textproto.Error
+	permanent := errors.As(relayErr, &smtpErr) && smtpErr.Code >= 500
+	if permanent || job.attempt >= maxAttempts {
+		d.bounce(job, relayErr)
+		return
+	}
+	backoff := minRetryBackoff << uint(job.attempt-1)
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	log.Warn().Str("module", "relay").Str("mailbox", job.msg.Mailbox).Err(relayErr).
+		Int("attempt", job.attempt).Dur("backoff", backoff).Msg("Relay attempt failed, retrying")
+	time.AfterFunc(backoff, func() {
+		select {
+		case d.jobs <- job:
+		default:
+			droppedCount.Add(1)
+		}
+	})
+}
+
+// bounce writes a synthesized delivery status notification back into the original mailbox so
+// the sender can see the relay permanently failed.
+func (d *Dispatcher) bounce(job relayJob, relayErr error) {
+	bouncedCount.Add(1)
+	log.Error().Str("module", "relay").Str("mailbox", job.msg.Mailbox).Err(relayErr).
+		Msg("Relay permanently failed, bouncing")
+
+	dsn := fmt.Sprintf(
+		"From: Mail Delivery Subsystem <mailer-daemon@inbucket>\r\n"+
+			"To: %s\r\n"+
+			"Subject: Undelivered Mail Returned to Sender\r\n"+
+			"Content-Type: text/plain\r\n\r\n"+
+			"The relay to %s matching rule %q failed permanently after %d attempts:\r\n%s\r\n",
+		job.msg.Mailbox, job.rule.Smarthost, job.rule.Match, job.attempt, relayErr)
+
+	delivery, err := message.ParseDelivery(bytes.NewReader([]byte(dsn)), job.msg.Mailbox)
+	if err != nil {
+		log.Error().Str("module", "relay").Err(err).Msg("Failed to build bounce DSN")
+		return
+	}
+	// Deliver the DSN directly to storage, bypassing StoreManager.Deliver, so a bounce can
+	// never re-trigger the Dispatcher chain that produced it.
+	if _, err := d.store.Store.AddMessage(delivery); err != nil {
+		log.Error().Str("module", "relay").Err(err).Msg("Failed to store bounce DSN")
+	}
+}
@@ -0,0 +1,69 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	ibxlog "github.com/inbucket/inbucket/pkg/log"
+)
+
+// logManager is the same log.Manager main constructed at startup, so this endpoint and the
+// SIGHUP handler operate on identical state. It is nil until SetupAdminRoutes is called.
+var logManager *ibxlog.Manager
+
+// adminToken gates access to the admin routes; set by SetupAdminRoutes from configuration.
+var adminToken string
+
+// adminLogRequest is the body accepted by PUT /api/v1/admin/log. Any combination of fields
+// may be set; omitted fields are left unchanged.
+type adminLogRequest struct {
+	Level  string `json:"level,omitempty"`
+	Reopen bool   `json:"reopen,omitempty"`
+}
+
+// SetupAdminRoutes registers the authenticated log-control endpoint that stands in for SIGHUP
+// on platforms, such as Windows, that have no such signal. If no token is configured the route
+// is not registered at all, rather than being registered and unconditionally rejecting
+// requests.
+func SetupAdminRoutes(r *mux.Router, mgr *ibxlog.Manager, token string) {
+	if token == "" {
+		return
+	}
+	logManager = mgr
+	adminToken = token
+	r.Path("/log").Methods("PUT").HandlerFunc(handleAdminLog)
+}
+
+// handleAdminLog applies a runtime log-level change and/or reopens the logfile -- the same two
+// operations the SIGHUP handler performs on unix.
+func handleAdminLog(w http.ResponseWriter, req *http.Request) {
+	if !adminAuthorized(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body adminLogRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Level != "" {
+		if err := logManager.SetLevel(body.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.Reopen {
+		if err := logManager.Reopen(); err != nil {
+			http.Error(w, "failed to reopen logfile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminAuthorized requires a bearer token matching the configured admin token. adminToken is
+// never empty here since SetupAdminRoutes declines to register this handler without one.
+func adminAuthorized(req *http.Request) bool {
+	return req.Header.Get("Authorization") == "Bearer "+adminToken
+}
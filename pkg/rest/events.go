@@ -0,0 +1,180 @@
+package rest
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// eventSendBuffer bounds how many unsent events a single connection may queue before it
+	// is considered a slow consumer and dropped.
+	eventSendBuffer = 32
+
+	eventPingPeriod = 30 * time.Second
+	eventWriteWait  = 10 * time.Second
+
+	// wsCloseSlowConsumer is a private-use WebSocket close code (RFC 6455 section 7.4.2)
+	// signaling that the server dropped the connection for not draining fast enough.
+	wsCloseSlowConsumer = 4000
+)
+
+var eventUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// wsEvent is the JSON payload streamed to WebSocket subscribers.
+type wsEvent struct {
+	Type    string            `json:"type"` // message-stored, message-deleted, mailbox-purged
+	Mailbox string            `json:"mailbox"`
+	Message *message.Metadata `json:"message,omitempty"`
+}
+
+// SetupEventRoutes registers the v2 WebSocket event-streaming endpoints: /events streams
+// every mailbox (optionally narrowed with a ?mailbox=a,b query filter), while
+// /mailbox/{name}/events is implicitly filtered to a single mailbox.
+func SetupEventRoutes(r *mux.Router, hub *msghub.Hub) {
+	r.Path("/events").Methods("GET").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveEvents(w, req, hub, queryMailboxFilter(req))
+	})
+	r.Path("/mailbox/{name}/events").Methods("GET").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveEvents(w, req, hub, []string{mux.Vars(req)["name"]})
+	})
+}
+
+// queryMailboxFilter parses the optional comma-separated ?mailbox= query param.
+func queryMailboxFilter(req *http.Request) []string {
+	v := req.URL.Query().Get("mailbox")
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// serveEvents upgrades the request to a WebSocket, subscribes to hub, and streams events
+// matching filter (all mailboxes if filter is empty) until the client disconnects or falls
+// behind.
+func serveEvents(w http.ResponseWriter, req *http.Request, hub *msghub.Hub, filter []string) {
+	conn, err := eventUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Warn().Str("module", "rest").Err(err).Msg("Failed to upgrade WebSocket connection")
+		return
+	}
+	defer conn.Close()
+
+	listener := hub.Subscribe()
+	defer listener.Close()
+	events := listener.Start()
+
+	// Buffer outgoing events so a slow reader doesn't back-pressure the hub's fan-out; if the
+	// buffer fills we close the connection rather than block. pump is the only goroutine
+	// allowed to write to conn -- gorilla/websocket forbids concurrent writers -- so the
+	// heartbeat ping lives there too, not in this loop.
+	outbox := make(chan msghub.Message, eventSendBuffer)
+	closeSlow := make(chan struct{})
+	pumpDone := make(chan struct{})
+	go func() {
+		defer close(pumpDone)
+		pump(conn, outbox, closeSlow)
+	}()
+	defer func() {
+		// Closing outbox lets pump drain and exit; without this it would block forever on
+		// outbox once this handler returns, leaking the goroutine and the connection.
+		close(outbox)
+		<-pumpDone
+	}()
+
+	for {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				return
+			}
+			if !matchesFilter(msg.Mailbox, filter) {
+				continue
+			}
+			select {
+			case outbox <- msg:
+			default:
+				// Signal pump to send the close frame itself -- pump is the sole writer of
+				// conn, so this goroutine must never write the close frame directly while
+				// pump may still be mid-write.
+				close(closeSlow)
+				return
+			}
+		case <-pumpDone:
+			// pump hit a write error (client gone, ping failed, ...); stop reading from the
+			// hub too.
+			return
+		}
+	}
+}
+
+// pump is the sole writer of conn: it relays buffered events as JSON text frames, sends the
+// periodic heartbeat ping, and sends the slow-consumer close frame, all from the same select
+// loop so gorilla/websocket never sees two goroutines writing at once. It returns when outbox
+// is closed, closeSlow is closed, or a write fails.
+func pump(conn *websocket.Conn, outbox <-chan msghub.Message, closeSlow <-chan struct{}) {
+	ticker := time.NewTicker(eventPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-outbox:
+			if !ok {
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(eventWriteWait))
+			if err := conn.WriteJSON(toWSEvent(msg)); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(eventWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closeSlow:
+			closeSlowConsumer(conn)
+			return
+		}
+	}
+}
+
+// toWSEvent converts an internal msghub.Message into the wire format documented for
+// /api/v2/events.
+func toWSEvent(msg msghub.Message) wsEvent {
+	ev := wsEvent{Type: msg.Event, Mailbox: msg.Mailbox}
+	if msg.Metadata != nil {
+		ev.Message = msg.Metadata
+	}
+	return ev
+}
+
+// matchesFilter reports whether mailbox should be delivered given an optional
+// case-insensitive allow-list; an empty filter matches everything.
+func matchesFilter(mailbox string, filter []string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if strings.EqualFold(mailbox, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeSlowConsumer disconnects a subscriber that isn't draining events fast enough, rather
+// than letting it back-pressure the hub.
+func closeSlowConsumer(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(wsCloseSlowConsumer, "slow consumer")
+	_ = conn.SetWriteDeadline(time.Now().Add(eventWriteWait))
+	_ = conn.WriteMessage(websocket.CloseMessage, msg)
+}
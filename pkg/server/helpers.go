@@ -2,7 +2,11 @@ package server
 
 import "context"
 
+// IServer is implemented by every long-running Inbucket subsystem (POP3, SMTP, IMAP, web,
+// retention scanner, msghub, ...) so it can be registered with a Supervisor.
 type IServer interface {
-	Start(ctx context.Context)
-	Drain()
+	// Serve runs the subsystem until ctx is canceled or it hits a fatal error, and must not
+	// return until any goroutines it started have stopped. A non-nil error returned before
+	// ctx is canceled is treated as unexpected and may cause the Supervisor to restart it.
+	Serve(ctx context.Context) error
 }
@@ -0,0 +1,254 @@
+package imap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// capabilityString advertises the command set this server implements.
+const capabilityString = "IMAP4rev1 IDLE"
+
+// inboxName is the single mailbox Inbucket exposes per IMAP login; the username supplied at
+// LOGIN selects which store mailbox it maps to.
+const inboxName = "INBOX"
+
+// dispatch routes a parsed command to its handler, rejecting anything not valid for the
+// session's current state.
+func (s *session) dispatch(tag, cmd, args string) error {
+	switch cmd {
+	case "CAPABILITY":
+		return s.cmdCapability(tag)
+	case "NOOP":
+		return s.cmdNoop(tag)
+	case "LOGOUT":
+		return s.cmdLogout(tag)
+	case "LOGIN":
+		return s.cmdLogin(tag, args)
+	}
+
+	if s.state == stateNotAuthenticated {
+		return s.bad(tag, cmd+" invalid in not authenticated state")
+	}
+
+	switch cmd {
+	case "SELECT":
+		return s.cmdSelect(tag, args, false)
+	case "EXAMINE":
+		return s.cmdSelect(tag, args, true)
+	case "LIST":
+		return s.cmdList(tag, args, "LIST")
+	case "LSUB":
+		return s.cmdList(tag, args, "LSUB")
+	case "IDLE":
+		return s.cmdIdle(tag)
+	}
+
+	if s.state != stateSelected {
+		return s.bad(tag, cmd+" requires a selected mailbox")
+	}
+
+	switch cmd {
+	case "FETCH":
+		return s.cmdFetch(tag, args, false)
+	case "UID":
+		return s.cmdUID(tag, args)
+	case "STORE":
+		return s.cmdStore(tag, args, false)
+	case "EXPUNGE":
+		return s.cmdExpunge(tag)
+	case "CLOSE":
+		s.state = stateAuthenticated
+		return s.ok(tag, cmd, "")
+	default:
+		return s.bad(tag, "unknown command "+cmd)
+	}
+}
+
+func (s *session) cmdCapability(tag string) error {
+	if err := s.writeLine("* CAPABILITY " + capabilityString); err != nil {
+		return err
+	}
+	return s.ok(tag, "CAPABILITY", "")
+}
+
+func (s *session) cmdNoop(tag string) error {
+	return s.ok(tag, "NOOP", "")
+}
+
+func (s *session) cmdLogout(tag string) error {
+	if err := s.writeLine("* BYE Inbucket IMAP server signing off"); err != nil {
+		return err
+	}
+	s.state = stateLogout
+	return s.ok(tag, "LOGOUT", "")
+}
+
+// cmdLogin accepts any credentials, mirroring the POP3 server: the username becomes the
+// mailbox name Inbucket serves back as INBOX.
+func (s *session) cmdLogin(tag, args string) error {
+	parts := splitQuotedArgs(args)
+	if len(parts) < 2 {
+		return s.bad(tag, "LOGIN requires a username and password")
+	}
+	s.mailbox = parts[0]
+	s.uids = newUIDMap(s.server.uidValidity)
+	s.state = stateAuthenticated
+	return s.ok(tag, "LOGIN", "")
+}
+
+// cmdSelect opens the caller's single INBOX, either read-write (SELECT) or read-only (EXAMINE).
+func (s *session) cmdSelect(tag, args string, readOnly bool) error {
+	name := strings.Trim(args, `"`)
+	if !strings.EqualFold(name, inboxName) {
+		return s.no(tag, "Mailbox does not exist")
+	}
+	messages, err := s.server.store.GetMessages(s.mailbox)
+	if err != nil {
+		return s.no(tag, "Unable to open mailbox: "+err.Error())
+	}
+	s.uids.sync(messages)
+	s.readOnly = readOnly
+	s.state = stateSelected
+
+	if err := s.writeLine(fmt.Sprintf("* %d EXISTS", len(messages))); err != nil {
+		return err
+	}
+	if err := s.writeLine("* 0 RECENT"); err != nil {
+		return err
+	}
+	if err := s.writeLine("* FLAGS (\\Seen)"); err != nil {
+		return err
+	}
+	if err := s.writeLine("* OK [PERMANENTFLAGS (\\Seen)] Limited"); err != nil {
+		return err
+	}
+	if err := s.writeLine(fmt.Sprintf("* OK [UIDVALIDITY %d] UIDs valid", s.uids.validity)); err != nil {
+		return err
+	}
+	if err := s.writeLine(fmt.Sprintf("* OK [UIDNEXT %d] Predicted next UID", s.uids.next)); err != nil {
+		return err
+	}
+	cmd := "SELECT"
+	if readOnly {
+		cmd = "EXAMINE"
+		return s.ok(tag, cmd, "[READ-ONLY] "+cmd+" completed")
+	}
+	return s.ok(tag, cmd, "[READ-WRITE] "+cmd+" completed")
+}
+
+// cmdList handles LIST and LSUB, both of which only ever see a single INBOX per mailbox.
+func (s *session) cmdList(tag, args, name string) error {
+	parts := splitQuotedArgs(args)
+	if len(parts) == 2 && parts[1] != "" {
+		pattern := strings.Trim(parts[1], `"`)
+		if pattern != "*" && pattern != "%" && !strings.EqualFold(pattern, inboxName) {
+			return s.ok(tag, name, "")
+		}
+	}
+	if err := s.writeLine(fmt.Sprintf(`* %s (\Unmarked) "/" "%s"`, name, inboxName)); err != nil {
+		return err
+	}
+	return s.ok(tag, name, "")
+}
+
+// cmdUID handles the "UID FETCH"/"UID STORE"/"UID SEARCH" family, dispatching on the
+// sub-command with its set argument read as UIDs rather than sequence numbers. FETCH responses
+// still carry sequence numbers; UID FETCH adds the UID item and UID SEARCH returns UIDs.
+func (s *session) cmdUID(tag, args string) error {
+	parts := strings.SplitN(args, " ", 2)
+	if len(parts) == 0 {
+		return s.bad(tag, "UID requires a sub-command")
+	}
+	sub := strings.ToUpper(parts[0])
+	var rest string
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+	switch sub {
+	case "FETCH":
+		return s.cmdFetch(tag, rest, true)
+	case "STORE":
+		return s.cmdStore(tag, rest, true)
+	case "SEARCH":
+		return s.cmdSearch(tag, rest)
+	default:
+		return s.bad(tag, "unknown UID sub-command "+sub)
+	}
+}
+
+// cmdSearch implements the minimal subset Inbucket needs: ALL and UID ranges (e.g.
+// "UID 5:*"), enough for clients that search for newly arrived mail after an IDLE wakes them.
+// Any other search criteria are ignored and match every message.
+func (s *session) cmdSearch(tag, args string) error {
+	var ranges []seqRange
+	if f := strings.Fields(args); len(f) == 2 && strings.EqualFold(f[0], "UID") {
+		var err error
+		if ranges, err = parseRanges(f[1]); err != nil {
+			return s.bad(tag, err.Error())
+		}
+	}
+	messages, err := s.server.store.GetMessages(s.mailbox)
+	if err != nil {
+		return s.no(tag, "Search failed: "+err.Error())
+	}
+	s.uids.sync(messages)
+	uids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		uid := s.uids.uidFor(m.ID())
+		matched := ranges == nil
+		for _, r := range ranges {
+			if int(uid) >= r.lo && int(uid) <= r.hi {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			uids = append(uids, strconv.FormatUint(uint64(uid), 10))
+		}
+	}
+	if err := s.writeLine("* SEARCH " + strings.Join(uids, " ")); err != nil {
+		return err
+	}
+	return s.ok(tag, "SEARCH", "")
+}
+
+// cmdExpunge acknowledges EXPUNGE. Inbucket has no \Deleted flag, so nothing is removed and no
+// untagged EXPUNGE responses are sent; it only re-syncs the UID map, which assigns UIDs to new
+// messages and keeps the entries of messages no longer in the store.
+func (s *session) cmdExpunge(tag string) error {
+	messages, err := s.server.store.GetMessages(s.mailbox)
+	if err != nil {
+		return s.no(tag, "Expunge failed: "+err.Error())
+	}
+	s.uids.sync(messages)
+	return s.ok(tag, "EXPUNGE", "")
+}
+
+// splitQuotedArgs splits an IMAP argument string on spaces while treating "quoted strings"
+// as a single field (an empty "" yields an empty field).
+func splitQuotedArgs(args string) []string {
+	var out []string
+	var cur strings.Builder
+	inQuote, inField := false, false
+	for _, r := range args {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			inField = true
+		case r == ' ' && !inQuote:
+			if inField {
+				out = append(out, cur.String())
+				cur.Reset()
+				inField = false
+			}
+		default:
+			cur.WriteRune(r)
+			inField = true
+		}
+	}
+	if inField {
+		out = append(out, cur.String())
+	}
+	return out
+}
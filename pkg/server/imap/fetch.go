@@ -0,0 +1,312 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+// cmdFetch implements FETCH and UID FETCH for the attribute set Inbucket's read-only view
+// supports: UID, FLAGS, ENVELOPE, BODYSTRUCTURE, and BODY[]/BODY.PEEK[] with a section.
+func (s *session) cmdFetch(tag, args string, byUID bool) error {
+	parts := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(parts) < 2 {
+		return s.bad(tag, "FETCH requires a sequence set and attribute list")
+	}
+	seqSet, attrs := parts[0], parts[1]
+
+	messages, err := s.server.store.GetMessages(s.mailbox)
+	if err != nil {
+		return s.no(tag, "FETCH failed: "+err.Error())
+	}
+	s.uids.sync(messages)
+
+	selected, err := s.resolveSet(seqSet, messages, byUID)
+	if err != nil {
+		return s.bad(tag, err.Error())
+	}
+	wantAttrs := parseFetchAttrs(attrs)
+
+	for _, item := range selected {
+		line, err := s.fetchResponse(item.seq, item.msg, wantAttrs, byUID)
+		if err != nil {
+			return s.no(tag, "FETCH failed: "+err.Error())
+		}
+		if err := s.writeLine(line); err != nil {
+			return err
+		}
+	}
+	return s.ok(tag, "FETCH", "")
+}
+
+// fetchResponse builds the "* <seq> FETCH (...)" line for one message. Per RFC 3501 section
+// 6.4.8, a UID FETCH response must always include the UID data item even if the client didn't
+// ask for it, so byUID forces it in regardless of attrs.
+func (s *session) fetchResponse(seq int, m storage.Message, attrs []string, byUID bool) (string, error) {
+	uid := s.uids.uidFor(m.ID())
+	var fields []string
+	haveUID := false
+	for _, a := range attrs {
+		switch {
+		case a == "UID":
+			fields = append(fields, fmt.Sprintf("UID %d", uid))
+			haveUID = true
+		case a == "FLAGS":
+			flags := ""
+			if m.Seen() {
+				flags = "\\Seen"
+			}
+			fields = append(fields, fmt.Sprintf("FLAGS (%s)", flags))
+		case a == "ENVELOPE":
+			fields = append(fields, "ENVELOPE "+envelopeString(m))
+		case a == "BODYSTRUCTURE":
+			structure, err := bodyStructure(m)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, "BODYSTRUCTURE "+structure)
+		case strings.HasPrefix(a, "BODY"):
+			body, err := bodySection(m, a)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, body)
+			if !strings.Contains(a, ".PEEK") && !m.Seen() && !s.readOnly {
+				if err := s.server.store.MarkSeen(s.mailbox, m.ID()); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	if byUID && !haveUID {
+		fields = append([]string{fmt.Sprintf("UID %d", uid)}, fields...)
+	}
+	return fmt.Sprintf("* %d FETCH (%s)", seq, strings.Join(fields, " ")), nil
+}
+
+// envelopeString renders a minimal RFC 3501 ENVELOPE structure from message metadata.
+func envelopeString(m storage.Message) string {
+	from := "NIL"
+	if addr := m.From(); addr != nil {
+		from = fmt.Sprintf(`(("%s" NIL "%s" "%s"))`, addr.Name, addrLocal(addr.Address), addrDomain(addr.Address))
+	}
+	return fmt.Sprintf(`(%q %q %s NIL NIL NIL NIL NIL NIL NIL)`,
+		m.Date().Format("02-Jan-2006 15:04:05 -0700"), m.Subject(), from)
+}
+
+// bodyStructure renders a minimal single-part RFC 3501 BODYSTRUCTURE, reporting the actual
+// octet and line counts of the stored message rather than always claiming an empty body.
+func bodyStructure(m storage.Message) (string, error) {
+	rc, err := m.Source()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	raw, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+	octets := len(raw)
+	lines := bytes.Count(raw, []byte("\n"))
+	return fmt.Sprintf(`("TEXT" "PLAIN" NIL NIL NIL "7BIT" %d %d)`, octets, lines), nil
+}
+
+func addrLocal(addr string) string {
+	if i := strings.IndexByte(addr, '@'); i >= 0 {
+		return addr[:i]
+	}
+	return addr
+}
+
+func addrDomain(addr string) string {
+	if i := strings.IndexByte(addr, '@'); i >= 0 {
+		return addr[i+1:]
+	}
+	return ""
+}
+
+// bodySection returns the literal response for BODY[]/BODY.PEEK[] with an optional section,
+// e.g. "BODY[]", "BODY[HEADER]", or "BODY.PEEK[TEXT]". storage.Message only exposes the raw
+// message source, so HEADER and TEXT are carved out of it directly; any other section (a MIME
+// part number, HEADER.FIELDS, ...) falls back to the whole message rather than erroring.
+func bodySection(m storage.Message, attr string) (string, error) {
+	rc, err := m.Source()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	raw, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+	name := strings.Replace(attr, ".PEEK", "", 1)
+	data := sectionData(raw, sectionOf(name))
+	return fmt.Sprintf("%s {%d}\r\n%s", name, len(data), data), nil
+}
+
+// sectionOf extracts the bracketed section spec from a BODY[...] attribute, e.g. "HEADER" from
+// "BODY[HEADER]" or "" from "BODY[]".
+func sectionOf(attr string) string {
+	i := strings.IndexByte(attr, '[')
+	j := strings.LastIndexByte(attr, ']')
+	if i < 0 || j < 0 || j < i {
+		return ""
+	}
+	return strings.ToUpper(attr[i+1 : j])
+}
+
+// sectionData returns the bytes of the requested top-level section, splitting raw on its
+// header/body blank-line separator for HEADER and TEXT.
+func sectionData(raw []byte, section string) []byte {
+	switch section {
+	case "HEADER":
+		header, _ := splitHeaderBody(raw)
+		return header
+	case "TEXT":
+		_, body := splitHeaderBody(raw)
+		return body
+	default:
+		return raw
+	}
+}
+
+// splitHeaderBody splits a raw RFC 5322 message into its header block (including the trailing
+// blank line) and body at the first blank line.
+func splitHeaderBody(raw []byte) (header, body []byte) {
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[:i+4], raw[i+4:]
+	}
+	if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		return raw[:i+2], raw[i+2:]
+	}
+	return raw, nil
+}
+
+// parseFetchAttrs expands shorthand macros (ALL, FULL, FAST) and strips the surrounding
+// parens from an explicit attribute list.
+func parseFetchAttrs(attrs string) []string {
+	attrs = strings.Trim(attrs, "()")
+	switch strings.ToUpper(attrs) {
+	case "ALL":
+		return []string{"FLAGS", "ENVELOPE"}
+	case "FULL":
+		return []string{"FLAGS", "ENVELOPE", "BODYSTRUCTURE"}
+	case "FAST":
+		return []string{"FLAGS"}
+	}
+	return strings.Fields(attrs)
+}
+
+// fetchItem pairs a matched message with its 1-based sequence number.
+type fetchItem struct {
+	seq int
+	msg storage.Message
+}
+
+// seqRange is an inclusive bound parsed from one comma-separated element of a sequence set.
+type seqRange struct {
+	lo, hi int
+}
+
+// resolveSet expands a sequence-set or UID-set string into the matching messages, in ascending
+// sequence-number order -- clients assume FETCH/STORE responses arrive in that order, so this
+// walks messages in order rather than collecting matches in a map (unordered iteration).
+func (s *session) resolveSet(set string, messages []storage.Message, byUID bool) ([]fetchItem, error) {
+	ranges, err := parseRanges(set)
+	if err != nil {
+		return nil, err
+	}
+	var selected []fetchItem
+	for i, m := range messages {
+		seqNum := i + 1
+		key := seqNum
+		if byUID {
+			key = int(s.uids.uidFor(m.ID()))
+		}
+		for _, r := range ranges {
+			if key >= r.lo && key <= r.hi {
+				selected = append(selected, fetchItem{seq: seqNum, msg: m})
+				break
+			}
+		}
+	}
+	return selected, nil
+}
+
+// parseRanges parses a comma-separated sequence set into its inclusive bounds.
+func parseRanges(set string) ([]seqRange, error) {
+	parts := strings.Split(set, ",")
+	ranges := make([]seqRange, 0, len(parts))
+	for _, p := range parts {
+		lo, hi, err := parseRange(p)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, seqRange{lo: lo, hi: hi})
+	}
+	return ranges, nil
+}
+
+// parseRange parses "N", "N:M", or "N:*" into inclusive bounds.
+func parseRange(r string) (int, int, error) {
+	parts := strings.SplitN(r, ":", 2)
+	lo, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid sequence number %q", parts[0])
+	}
+	if len(parts) == 1 {
+		return lo, lo, nil
+	}
+	if parts[1] == "*" {
+		return lo, int(^uint(0) >> 1), nil
+	}
+	hi, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid sequence number %q", parts[1])
+	}
+	return lo, hi, nil
+}
+
+// cmdStore implements STORE and UID STORE for the \Seen flag, the only one Inbucket's
+// Metadata tracks. storage.Store only exposes MarkSeen, with no way to clear it again, so a
+// request to remove \Seen is rejected with NO rather than silently acknowledged.
+func (s *session) cmdStore(tag, args string, byUID bool) error {
+	parts := strings.SplitN(strings.TrimSpace(args), " ", 3)
+	if len(parts) < 3 {
+		return s.bad(tag, "STORE requires a sequence set, item, and value")
+	}
+	seqSet, item, value := parts[0], strings.ToUpper(parts[1]), parts[2]
+	if !strings.Contains(value, "\\Seen") && !strings.Contains(value, "\\SEEN") {
+		// Nothing Inbucket tracks was touched; acknowledge without error.
+		return s.ok(tag, "STORE", "")
+	}
+	if strings.HasPrefix(item, "-") {
+		return s.no(tag, "STORE cannot clear \\Seen: not supported by this server")
+	}
+	if s.readOnly {
+		return s.no(tag, "STORE not permitted: mailbox was opened with EXAMINE")
+	}
+
+	messages, err := s.server.store.GetMessages(s.mailbox)
+	if err != nil {
+		return s.no(tag, "STORE failed: "+err.Error())
+	}
+	s.uids.sync(messages)
+	selected, err := s.resolveSet(seqSet, messages, byUID)
+	if err != nil {
+		return s.bad(tag, err.Error())
+	}
+	for _, item := range selected {
+		if err := s.server.store.MarkSeen(s.mailbox, item.msg.ID()); err != nil {
+			return s.no(tag, "STORE failed: "+err.Error())
+		}
+		if err := s.writeLine(fmt.Sprintf("* %d FETCH (FLAGS (\\Seen))", item.seq)); err != nil {
+			return err
+		}
+	}
+	return s.ok(tag, "STORE", "")
+}
@@ -0,0 +1,121 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+// cmdIdle implements the IDLE extension (RFC 2177) until the client sends "DONE". Untagged
+// EXISTS/EXPUNGE responses are pushed only when a msghub event for the selected mailbox arrives
+// (StoreManager publishes one for each delivered message); a message removed without such an
+// event is reported as EXPUNGE with the next event for that mailbox.
+func (s *session) cmdIdle(tag string) error {
+	if err := s.writeLine("+ idling"); err != nil {
+		return err
+	}
+
+	// readCommand's per-command deadline was set before IDLE was dispatched and would otherwise
+	// fire on this goroutine's blocking read for "DONE", killing arbitrarily long idle periods.
+	// Clear it for the duration of IDLE; readCommand re-arms a fresh deadline for the next
+	// command once this one returns.
+	_ = s.conn.SetReadDeadline(time.Time{})
+
+	s.listener = s.server.hub.Subscribe()
+	defer func() {
+		s.listener.Close()
+		s.listener = nil
+	}()
+	events := s.listener.Start()
+
+	messages, err := s.server.store.GetMessages(s.mailbox)
+	if err != nil {
+		return err
+	}
+	s.uids.sync(messages)
+	known := uidSequence(s.uids, messages)
+
+	done := make(chan error, 1)
+	go func() {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			done <- err
+			return
+		}
+		if strings.TrimSpace(line) != "DONE" {
+			// Not strictly spec compliant, but matches this server's otherwise
+			// permissive handling elsewhere: just stop idling.
+		}
+		done <- nil
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+			return s.ok(tag, "IDLE", "")
+		case msg, ok := <-events:
+			if !ok {
+				return s.ok(tag, "IDLE", "")
+			}
+			known, err = s.reportHubMessage(msg, known)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reportHubMessage sends the untagged EXPUNGE/EXISTS updates that correspond to a msghub event
+// for the currently selected mailbox, ignoring events for other mailboxes, and returns the
+// sequence-ordered UID list to pass to the next call. known is compared against the mailbox's
+// current contents: any UID that's gone is reported via EXPUNGE (RFC 3501 requires this instead
+// of ever sending a smaller EXISTS), and a message count larger than what remains after those
+// EXPUNGEs is reported via EXISTS.
+func (s *session) reportHubMessage(msg msghub.Message, known []uint32) ([]uint32, error) {
+	if !strings.EqualFold(msg.Mailbox, s.mailbox) {
+		return known, nil
+	}
+	messages, err := s.server.store.GetMessages(s.mailbox)
+	if err != nil {
+		return known, err
+	}
+	s.uids.sync(messages)
+	current := uidSequence(s.uids, messages)
+
+	present := make(map[uint32]bool, len(current))
+	for _, uid := range current {
+		present[uid] = true
+	}
+	// Walk known highest-sequence-first so removing one expunged message never shifts the
+	// sequence number of another expunged message still waiting to be reported.
+	expunged := 0
+	for seq := len(known); seq >= 1; seq-- {
+		if uid := known[seq-1]; !present[uid] {
+			if err := s.writeLine(fmt.Sprintf("* %d EXPUNGE", seq)); err != nil {
+				return current, err
+			}
+			expunged++
+		}
+	}
+	if len(current) > len(known)-expunged {
+		if err := s.writeLine(fmt.Sprintf("* %d EXISTS", len(current))); err != nil {
+			return current, err
+		}
+	}
+	return current, nil
+}
+
+// uidSequence returns messages' UIDs in sequence-number order (1-based position == index+1).
+func uidSequence(uids *uidMap, messages []storage.Message) []uint32 {
+	seq := make([]uint32, len(messages))
+	for i, m := range messages {
+		seq[i] = uids.uidFor(m.ID())
+	}
+	return seq
+}
@@ -0,0 +1,125 @@
+// Package imap implements a read-only IMAP4rev1 (RFC 3501) server on top of
+// Inbucket's storage.Store, sharing the same per-mailbox model as the POP3
+// and SMTP servers.
+package imap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// Server defines an instance of the IMAP server.
+type Server struct {
+	config      config.IMAP
+	address     string
+	addressType string
+	store       storage.Store   // Mail store.
+	hub         *msghub.Hub     // Message hub, used to drive IDLE.
+	listener    net.Listener    // TCP listener.
+	wg          *sync.WaitGroup // Waitgroup tracking sessions.
+
+	// uidValidity seeds every session's UIDVALIDITY (RFC 3501 section 2.3.1.1): Inbucket
+	// assigns UIDs in memory and loses them on restart, so this changes every time the
+	// process starts, telling clients their cached UIDs are no longer valid.
+	uidValidity uint32
+}
+
+// New creates a new Server struct.
+func New(
+	config config.IMAP,
+	address string,
+	addressType string,
+	store storage.Store,
+	hub *msghub.Hub,
+) *Server {
+	return &Server{
+		config:      config,
+		address:     address,
+		addressType: addressType,
+		store:       store,
+		hub:         hub,
+		wg:          new(sync.WaitGroup),
+		uidValidity: uint32(time.Now().Unix()),
+	}
+}
+
+// Serve starts the server, listens for connections, and blocks until ctx is canceled or the
+// listener hits a fatal error. It implements server.IServer for supervision by
+// server.Supervisor.
+func (s *Server) Serve(ctx context.Context) error {
+	slog := log.With().Str("module", "imap").Str("phase", "startup").Logger()
+	addr, err := net.ResolveTCPAddr(s.addressType, s.address)
+	if err != nil {
+		return fmt.Errorf("failed to build %s address: %w", s.addressType, err)
+	}
+	slog.Info().Str("addr", addr.String()).Msg("IMAP listening on " + s.addressType)
+	s.listener, err = net.ListenTCP("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start %s listener: %w", s.addressType, err)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.serve(ctx) }()
+
+	var fatal error
+	select {
+	case <-ctx.Done():
+	case fatal = <-serveErr:
+	}
+
+	slog = log.With().Str("module", "imap").Str("phase", "shutdown").Logger()
+	slog.Debug().Msg("IMAP shutdown requested, connections will be drained")
+	// Closing the listener will cause the serve() go routine to exit, if it hasn't already.
+	if err := s.listener.Close(); err != nil {
+		slog.Error().Err(err).Msg("Failed to close IMAP listener")
+	}
+	s.wg.Wait()
+	slog.Debug().Msg("IMAP connections have drained")
+	return fatal
+}
+
+// serve is the listen/accept loop; it returns nil when ctx is canceled, or a non-nil error
+// if the listener failed permanently for some other reason.
+func (s *Server) serve(ctx context.Context) error {
+	// Handle incoming connections.
+	var tempDelay time.Duration
+	for sid := 1; ; sid++ {
+		if conn, err := s.listener.Accept(); err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				// Temporary error, sleep for a bit and try again.
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Error().Str("module", "imap").Err(err).
+					Msgf("IMAP accept error; retrying in %v", tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				// IMAP is shutting down.
+				return nil
+			default:
+				// Something went wrong.
+				return err
+			}
+		} else {
+			tempDelay = 0
+			s.wg.Add(1)
+			go s.startSession(sid, conn)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// state tracks where a session sits in the IMAP connection state machine
+// defined by RFC 3501 section 3.
+type state int
+
+const (
+	stateNotAuthenticated state = iota
+	stateAuthenticated
+	stateSelected
+	stateLogout
+)
+
+// session tracks the state of a single IMAP client connection.
+type session struct {
+	server   *Server
+	id       int
+	conn     net.Conn
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	log      zerolog.Logger
+	state    state
+	mailbox  string // Currently selected mailbox, valid in stateSelected.
+	readOnly bool   // True if mailbox was opened with EXAMINE.
+	uids     *uidMap
+
+	listener *msghub.Listener // Non-nil while an IDLE command is in progress.
+}
+
+// startSession runs an IMAP session to completion, always signaling wg.Done() on exit. It is
+// started as a goroutine by Server.serve for every accepted connection.
+func (s *Server) startSession(id int, conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	sess := &session{
+		server: s,
+		id:     id,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		log: log.With().Str("module", "imap").Str("remote", conn.RemoteAddr().String()).
+			Int("sid", id).Logger(),
+		state: stateNotAuthenticated,
+	}
+	sess.log.Info().Msg("IMAP connection established")
+	sess.greet()
+
+	for sess.state != stateLogout {
+		if err := sess.readCommand(); err != nil {
+			sess.log.Warn().Err(err).Msg("IMAP session ending on error")
+			break
+		}
+	}
+	if sess.listener != nil {
+		sess.listener.Close()
+	}
+	sess.log.Info().Msg("IMAP connection closed")
+}
+
+// greet sends the untagged server ready response.
+func (s *session) greet() {
+	s.writeLine("* OK [CAPABILITY " + capabilityString + "] Inbucket IMAP4rev1 ready")
+}
+
+// readCommand reads and dispatches a single tagged command line.
+func (s *session) readCommand() error {
+	if s.server.config.Timeout > 0 {
+		_ = s.conn.SetReadDeadline(time.Now().Add(time.Duration(s.server.config.Timeout) * time.Second))
+	}
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil
+	}
+	if s.server.config.Debug {
+		s.log.Debug().Str("recv", line).Msg("IMAP debug")
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 {
+		return s.writeLine("* BAD malformed command")
+	}
+	tag := fields[0]
+	cmd := strings.ToUpper(fields[1])
+	var args string
+	if len(fields) == 3 {
+		args = fields[2]
+	}
+	return s.dispatch(tag, cmd, args)
+}
+
+// writeLine writes a single CRLF terminated response line and flushes the connection.
+func (s *session) writeLine(line string) error {
+	if s.server.config.Debug {
+		s.log.Debug().Str("send", line).Msg("IMAP debug")
+	}
+	if _, err := fmt.Fprintf(s.writer, "%s\r\n", line); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+// ok writes a tagged OK response for the given command.
+func (s *session) ok(tag, cmd, detail string) error {
+	if detail == "" {
+		detail = cmd + " completed"
+	}
+	return s.writeLine(tag + " OK " + detail)
+}
+
+// no writes a tagged NO response.
+func (s *session) no(tag, detail string) error {
+	return s.writeLine(tag + " NO " + detail)
+}
+
+// bad writes a tagged BAD response.
+func (s *session) bad(tag, detail string) error {
+	return s.writeLine(tag + " BAD " + detail)
+}
@@ -0,0 +1,45 @@
+package imap
+
+import "github.com/inbucket/inbucket/pkg/storage"
+
+// uidMap assigns stable, monotonically increasing IMAP UIDs to Inbucket's string message IDs
+// for the lifetime of a single SELECTed session, since the store itself has no concept of UIDs.
+type uidMap struct {
+	validity uint32
+	next     uint32
+	byID     map[string]uint32
+}
+
+// newUIDMap creates an empty map using validity as its UIDVALIDITY. Callers should derive
+// validity from server startup time (see Server.uidValidity) so a restarted Inbucket, which
+// loses all UID history, never reuses a validity value a client has already cached.
+func newUIDMap(validity uint32) *uidMap {
+	return &uidMap{
+		validity: validity,
+		next:     1,
+		byID:     make(map[string]uint32),
+	}
+}
+
+// sync assigns UIDs to any message IDs not already known, preserving existing assignments so
+// UIDs remain stable across SELECT/IDLE/FETCH calls within the session.
+func (m *uidMap) sync(messages []storage.Message) {
+	for _, msg := range messages {
+		if _, ok := m.byID[msg.ID()]; !ok {
+			m.byID[msg.ID()] = m.next
+			m.next++
+		}
+	}
+}
+
+// uidFor returns the UID assigned to a message ID, assigning one on the fly if sync hasn't
+// seen it yet.
+func (m *uidMap) uidFor(id string) uint32 {
+	if uid, ok := m.byID[id]; ok {
+		return uid
+	}
+	uid := m.next
+	m.byID[id] = uid
+	m.next++
+	return uid
+}
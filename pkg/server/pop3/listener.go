@@ -2,6 +2,7 @@ package pop3
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -13,59 +14,63 @@ import (
 
 // Server defines an instance of the POP3 server.
 type Server struct {
-	config         config.POP3
-	address        string
-	addressType    string
-	store          storage.Store   // Mail store.
-	listener       net.Listener    // TCP listener.
-	globalShutdown chan bool       // Inbucket shutdown signal.
-	wg             *sync.WaitGroup // Waitgroup tracking sessions.
+	config      config.POP3
+	address     string
+	addressType string
+	store       storage.Store   // Mail store.
+	listener    net.Listener    // TCP listener.
+	wg          *sync.WaitGroup // Waitgroup tracking sessions.
 }
 
 // New creates a new Server struct.
-func New(config config.POP3, address string, addressType string, shutdownChan chan bool, store storage.Store) *Server {
+func New(config config.POP3, address string, addressType string, store storage.Store) *Server {
 	return &Server{
-		config:         config,
-		address:        address,
-		addressType:    addressType,
-		store:          store,
-		globalShutdown: shutdownChan,
-		wg:             new(sync.WaitGroup),
+		config:      config,
+		address:     address,
+		addressType: addressType,
+		store:       store,
+		wg:          new(sync.WaitGroup),
 	}
 }
 
-// Start the server and listen for connections
-func (s *Server) Start(ctx context.Context) {
+// Serve starts the server, listens for connections, and blocks until ctx is canceled or the
+// listener hits a fatal error. It implements server.IServer for supervision by
+// server.Supervisor.
+func (s *Server) Serve(ctx context.Context) error {
 	slog := log.With().Str("module", "pop3").Str("phase", "startup").Logger()
 	addr, err := net.ResolveTCPAddr(s.addressType, s.address)
 	if err != nil {
-		slog.Error().Err(err).Msg("Failed to build " + s.addressType + " address")
-		s.emergencyShutdown()
-		return
+		return fmt.Errorf("failed to build %s address: %w", s.addressType, err)
 	}
 	slog.Info().Str("addr", addr.String()).Msg("POP3 listening on " + s.addressType)
 	s.listener, err = net.ListenTCP("tcp", addr)
 	if err != nil {
-		slog.Error().Err(err).Msg("Failed to start " + s.addressType + " listener")
-		s.emergencyShutdown()
-		return
+		return fmt.Errorf("failed to start %s listener: %w", s.addressType, err)
 	}
-	// Listener go routine.
-	go s.serve(ctx)
-	// Wait for shutdown.
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.serve(ctx) }()
+
+	var fatal error
 	select {
-	case _ = <-ctx.Done():
+	case <-ctx.Done():
+	case fatal = <-serveErr:
 	}
+
 	slog = log.With().Str("module", "pop3").Str("phase", "shutdown").Logger()
 	slog.Debug().Msg("POP3 shutdown requested, connections will be drained")
-	// Closing the listener will cause the serve() go routine to exit.
+	// Closing the listener will cause the serve() go routine to exit, if it hasn't already.
 	if err := s.listener.Close(); err != nil {
 		slog.Error().Err(err).Msg("Failed to close POP3 listener")
 	}
+	s.wg.Wait()
+	slog.Debug().Msg("POP3 connections have drained")
+	return fatal
 }
 
-// serve is the listen/accept loop.
-func (s *Server) serve(ctx context.Context) {
+// serve is the listen/accept loop; it returns nil when ctx is canceled, or a non-nil error
+// if the listener failed permanently for some other reason.
+func (s *Server) serve(ctx context.Context) error {
 	// Handle incoming connections.
 	var tempDelay time.Duration
 	for sid := 1; ; sid++ {
@@ -84,17 +89,14 @@ func (s *Server) serve(ctx context.Context) {
 					Msgf("POP3 accept error; retrying in %v", tempDelay)
 				time.Sleep(tempDelay)
 				continue
-			} else {
-				// Permanent error.
-				select {
-				case <-ctx.Done():
-					// POP3 is shutting down.
-					return
-				default:
-					// Something went wrong.
-					s.emergencyShutdown()
-					return
-				}
+			}
+			select {
+			case <-ctx.Done():
+				// POP3 is shutting down.
+				return nil
+			default:
+				// Something went wrong.
+				return err
 			}
 		} else {
 			tempDelay = 0
@@ -103,19 +105,3 @@ func (s *Server) serve(ctx context.Context) {
 		}
 	}
 }
-
-func (s *Server) emergencyShutdown() {
-	// Shutdown Inbucket
-	select {
-	case _ = <-s.globalShutdown:
-	default:
-		close(s.globalShutdown)
-	}
-}
-
-// Drain causes the caller to block until all active POP3 sessions have finished
-func (s *Server) Drain() {
-	// Wait for sessions to close
-	s.wg.Wait()
-	log.Debug().Str("module", "pop3").Str("phase", "shutdown").Msg("POP3 connections have drained")
-}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+
+	// maxConsecutiveFailures bounds how many times in a row a service may be restarted before
+	// it's considered fatal rather than merely flaky.
+	maxConsecutiveFailures = 5
+
+	// failureResetWindow is how long a service must run without error before its failure
+	// count is forgiven, so a service that fails once an hour doesn't eventually trip the
+	// fatal threshold.
+	failureResetWindow = time.Minute
+)
+
+// Supervisor owns the lifecycle of a set of named IServer subsystems, restarting any that
+// exit with an unexpected error using capped exponential backoff. A service that keeps
+// failing faster than failureResetWindow more than maxConsecutiveFailures times in a row is
+// treated as fatal: the Supervisor stops every other service and Serve returns that error, rather than
+// restarting forever. This replaces the hand-rolled globalShutdown channel and ServerTuple
+// fan-out main used to manage previously.
+type Supervisor struct {
+	mu       sync.Mutex
+	services []namedService
+	wg       sync.WaitGroup
+	errCh    chan error
+}
+
+type namedService struct {
+	name string
+	svc  IServer
+}
+
+// NewSupervisor creates an empty Supervisor.
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		errCh: make(chan error, 1),
+	}
+}
+
+// Add registers a subsystem to be started by Serve. Add must not be called after Serve.
+func (s *Supervisor) Add(name string, svc IServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.services = append(s.services, namedService{name: name, svc: svc})
+}
+
+// Serve starts every registered subsystem and blocks until ctx is canceled or a subsystem
+// fails fatally, then waits for all subsystems to finish shutting down before returning. A
+// nil error means ctx was canceled; anything else means a subsystem failed fatally and the
+// caller should treat the whole daemon as unhealthy.
+func (s *Supervisor) Serve(ctx context.Context) error {
+	s.mu.Lock()
+	services := s.services
+	s.mu.Unlock()
+
+	// runCtx is canceled both when the caller cancels ctx and when a service fails fatally,
+	// so one unrecoverable service stops every sibling rather than leaving them running
+	// forever while Serve waits on s.wg.
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for _, ns := range services {
+		s.wg.Add(1)
+		go s.run(runCtx, ns)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-s.errCh:
+		cancel()
+	}
+	s.wg.Wait()
+	return err
+}
+
+// run executes one subsystem, restarting it with capped exponential backoff after a
+// transient-looking error. Once it has failed more than maxConsecutiveFailures times without a
+// failureResetWindow-long healthy stretch in between, the failure is treated as fatal: it is
+// reported to Serve and this service stops restarting.
+func (s *Supervisor) run(ctx context.Context, ns namedService) {
+	defer s.wg.Done()
+	slog := log.With().Str("module", "supervisor").Str("service", ns.name).Logger()
+	backoff := minBackoff
+	failures := 0
+	for {
+		start := time.Now()
+		err := ns.svc.Serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			// Service exited cleanly of its own accord; nothing to restart.
+			return
+		}
+		if time.Since(start) >= failureResetWindow {
+			failures = 0
+			backoff = minBackoff
+		}
+		failures++
+		if failures > maxConsecutiveFailures {
+			slog.Error().Err(err).Int("failures", failures).
+				Msg("Service failed too many times in a row, giving up")
+			s.reportFatal(fmt.Errorf("service %q failed fatally: %w", ns.name, err))
+			return
+		}
+		slog.Error().Err(err).Dur("backoff", backoff).Msg("Service exited unexpectedly, restarting")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// reportFatal surfaces the first fatal subsystem error to Serve's caller without blocking.
+func (s *Supervisor) reportFatal(err error) {
+	select {
+	case s.errCh <- err:
+	default:
+	}
+}
+
+// FuncService adapts a plain ctx-aware function to the IServer interface, for subsystems
+// (such as the web server's Serve function) that don't otherwise need a dedicated type.
+type FuncService func(ctx context.Context) error
+
+// Serve implements IServer.
+func (f FuncService) Serve(ctx context.Context) error {
+	return f(ctx)
+}